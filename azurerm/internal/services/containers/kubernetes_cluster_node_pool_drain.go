@@ -0,0 +1,312 @@
+package containers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/containerservice/mgmt/2020-02-01/containerservice"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/terraform-providers/terraform-provider-azurerm/azurerm/internal/clients"
+	"github.com/terraform-providers/terraform-provider-azurerm/azurerm/internal/services/containers/parse"
+)
+
+// drainNodePool mirrors the semantics of `kubectl drain` for the nodes backing a single agent pool:
+// it cordons every VMSS-backed node carrying the `agentpool=<name>` label, then evicts their pods
+// (skipping mirror pods, and DaemonSet pods when `ignore_daemonsets` is set, honouring `pod_selector`)
+// with retry-on-429 backoff until
+// `timeout` elapses. It's invoked before deleting a node pool, or scaling one down, when the pool's
+// `drain_on_delete` block is configured. On delete the whole pool is being removed, so the blanket
+// cordon is final; on scale-down, callers must follow a successful update with
+// `uncordonSurvivingNodes` since there's no way to predict in advance which nodes Azure keeps.
+func drainNodePool(ctx context.Context, meta interface{}, id *parse.KubernetesNodePoolId, settings map[string]interface{}) error {
+	clustersClient := meta.(*clients.Client).Containers.KubernetesClustersClient
+
+	gracePeriodSeconds := int64(settings["grace_period_seconds"].(int))
+	deleteLocalData := settings["delete_local_data"].(bool)
+	force := settings["force"].(bool)
+	ignoreDaemonSets := settings["ignore_daemonsets"].(bool)
+	podSelector := settings["pod_selector"].(string)
+
+	timeout, err := time.ParseDuration(settings["timeout"].(string))
+	if err != nil {
+		return fmt.Errorf("parsing `drain_on_delete.0.timeout`: %+v", err)
+	}
+
+	drainCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	clientset, err := buildKubernetesClientForCluster(ctx, clustersClient, id.ResourceGroup, id.ClusterName)
+	if err != nil {
+		return err
+	}
+
+	nodeSelector := fmt.Sprintf("agentpool=%s", id.Name)
+	nodes, err := clientset.CoreV1().Nodes().List(drainCtx, metav1.ListOptions{LabelSelector: nodeSelector})
+	if err != nil {
+		return fmt.Errorf("listing nodes for Node Pool %q: %+v", id.Name, err)
+	}
+
+	if len(nodes.Items) == 0 {
+		log.Printf("[DEBUG] No nodes found for Node Pool %q (Kubernetes Cluster %q / Resource Group %q) - skipping drain", id.Name, id.ClusterName, id.ResourceGroup)
+		return nil
+	}
+
+	for _, node := range nodes.Items {
+		log.Printf("[DEBUG] Cordoning Node %q..", node.Name)
+		patch := []byte(`{"spec":{"unschedulable":true}}`)
+		if _, err := clientset.CoreV1().Nodes().Patch(drainCtx, node.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			return fmt.Errorf("cordoning Node %q: %+v", node.Name, err)
+		}
+	}
+
+	// Collect every pod to be evicted up-front (and run the `delete_local_data` precheck against the
+	// whole batch) before spawning any eviction goroutines, so a pod that fails the precheck can't
+	// leave earlier evictions in flight with nowhere to send their result.
+	var toEvict []corev1.Pod
+	for _, node := range nodes.Items {
+		listOptions := metav1.ListOptions{
+			FieldSelector: fmt.Sprintf("spec.nodeName=%s", node.Name),
+			LabelSelector: podSelector,
+		}
+
+		pods, err := clientset.CoreV1().Pods("").List(drainCtx, listOptions)
+		if err != nil {
+			return fmt.Errorf("listing pods on Node %q: %+v", node.Name, err)
+		}
+
+		for _, pod := range pods.Items {
+			if isMirrorPod(pod.Annotations) {
+				continue
+			}
+
+			if ignoreDaemonSets && isDaemonSetPod(pod.OwnerReferences) {
+				continue
+			}
+
+			if hasLocalStorage(pod) && !deleteLocalData {
+				return fmt.Errorf("pod %q/%q uses local storage and `delete_local_data` is not set", pod.Namespace, pod.Name)
+			}
+
+			toEvict = append(toEvict, pod)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(toEvict))
+
+	for _, pod := range toEvict {
+		wg.Add(1)
+		go func(namespace, name string) {
+			defer wg.Done()
+			errs <- evictPodWithRetry(drainCtx, clientset, namespace, name, gracePeriodSeconds)
+		}(pod.Namespace, pod.Name)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	var failed []error
+	for err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+
+	if len(failed) > 0 {
+		if !force {
+			return fmt.Errorf("%d pod(s) failed to evict within %s: %+v", len(failed), timeout, failed[0])
+		}
+		log.Printf("[DEBUG] %d pod(s) failed to evict within %s but `force` is set - continuing", len(failed), timeout)
+	}
+
+	return nil
+}
+
+func evictPodWithRetry(ctx context.Context, clientset kubernetes.Interface, namespace, name string, gracePeriodSeconds int64) error {
+	backoff := 1 * time.Second
+
+	for {
+		eviction := &policyv1beta1.Eviction{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+			},
+			DeleteOptions: &metav1.DeleteOptions{
+				GracePeriodSeconds: &gracePeriodSeconds,
+			},
+		}
+
+		err := clientset.PolicyV1beta1().Evictions(namespace).Evict(ctx, eviction)
+		if err == nil || apierrors.IsNotFound(err) {
+			return nil
+		}
+
+		if !apierrors.IsTooManyRequests(err) {
+			return fmt.Errorf("evicting pod %q/%q: %+v", namespace, name, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("evicting pod %q/%q: %+v", namespace, name, ctx.Err())
+		case <-time.After(backoff):
+		}
+
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+func isMirrorPod(annotations map[string]string) bool {
+	_, ok := annotations["kubernetes.io/config.mirror"]
+	return ok
+}
+
+func isDaemonSetPod(refs []metav1.OwnerReference) bool {
+	for _, ref := range refs {
+		if ref.Kind == "DaemonSet" {
+			return true
+		}
+	}
+	return false
+}
+
+func hasLocalStorage(pod corev1.Pod) bool {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.EmptyDir != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// buildKubernetesClientForCluster retrieves the cluster's admin kubeconfig and builds a client-go
+// Clientset from it - shared by the drain and node-pool-manifest codepaths.
+func buildKubernetesClientForCluster(ctx context.Context, clustersClient *containerservice.ManagedClustersClient, resourceGroup, clusterName string) (kubernetes.Interface, error) {
+	log.Printf("[DEBUG] Retrieving admin kubeconfig for Kubernetes Cluster %q (Resource Group %q)..", clusterName, resourceGroup)
+	credentials, err := clustersClient.ListClusterAdminCredentials(ctx, resourceGroup, clusterName)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving admin credentials for Kubernetes Cluster %q (Resource Group %q): %+v", clusterName, resourceGroup, err)
+	}
+	if credentials.Kubeconfigs == nil || len(*credentials.Kubeconfigs) == 0 {
+		return nil, fmt.Errorf("no kubeconfig was returned for Kubernetes Cluster %q (Resource Group %q)", clusterName, resourceGroup)
+	}
+
+	kubeConfigRaw := *(*credentials.Kubeconfigs)[0].Value
+	restConfig, err := clientcmd.RESTConfigFromKubeConfig(kubeConfigRaw)
+	if err != nil {
+		return nil, fmt.Errorf("building Kubernetes client config: %+v", err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("building Kubernetes client: %+v", err)
+	}
+
+	return clientset, nil
+}
+
+// patchNodesForPool patches the given annotations onto every Node backing `id`'s agent pool - used by
+// the companion `azurerm_kubernetes_node_pool_manifest` resource to apply (or, with a `nil` value,
+// remove) the Kubernetes-side annotations that AKS doesn't model against the agent pool API. A `nil`
+// value is marshalled as JSON `null`, which a merge-patch (RFC 7396) interprets as "delete this key".
+func patchNodesForPool(ctx context.Context, meta interface{}, id *parse.KubernetesNodePoolId, annotations map[string]interface{}) error {
+	clustersClient := meta.(*clients.Client).Containers.KubernetesClustersClient
+
+	clientset, err := buildKubernetesClientForCluster(ctx, clustersClient, id.ResourceGroup, id.ClusterName)
+	if err != nil {
+		return err
+	}
+
+	nodeSelector := fmt.Sprintf("agentpool=%s", id.Name)
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: nodeSelector})
+	if err != nil {
+		return fmt.Errorf("listing nodes for Node Pool %q: %+v", id.Name, err)
+	}
+
+	patch, err := jsonAnnotationsPatch(annotations)
+	if err != nil {
+		return fmt.Errorf("building annotations patch: %+v", err)
+	}
+
+	for _, node := range nodes.Items {
+		log.Printf("[DEBUG] Patching annotations on Node %q..", node.Name)
+		if _, err := clientset.CoreV1().Nodes().Patch(ctx, node.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			return fmt.Errorf("patching Node %q: %+v", node.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// nodeAnnotationsForPool returns the annotations carried by the (first) live Node backing `id`'s agent
+// pool, so that `azurerm_kubernetes_node_pool_manifest`'s Read can reconcile drift on the annotations
+// it manages. Returns an empty map if the pool currently has no nodes.
+func nodeAnnotationsForPool(ctx context.Context, meta interface{}, id *parse.KubernetesNodePoolId) (map[string]string, error) {
+	clustersClient := meta.(*clients.Client).Containers.KubernetesClustersClient
+
+	clientset, err := buildKubernetesClientForCluster(ctx, clustersClient, id.ResourceGroup, id.ClusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeSelector := fmt.Sprintf("agentpool=%s", id.Name)
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: nodeSelector})
+	if err != nil {
+		return nil, fmt.Errorf("listing nodes for Node Pool %q: %+v", id.Name, err)
+	}
+
+	if len(nodes.Items) == 0 {
+		return map[string]string{}, nil
+	}
+
+	return nodes.Items[0].Annotations, nil
+}
+
+// uncordonSurvivingNodes un-cordons every node still carrying the `agentpool=<name>` label once a
+// scale-down's `CreateOrUpdate` has completed. `drainNodePool` has no way to know in advance which
+// VMSS instances Azure will pick to remove, so it cordons the whole pool before draining; this
+// restores schedulability to whichever nodes turned out to survive the scale-down.
+func uncordonSurvivingNodes(ctx context.Context, meta interface{}, id *parse.KubernetesNodePoolId) error {
+	clustersClient := meta.(*clients.Client).Containers.KubernetesClustersClient
+
+	clientset, err := buildKubernetesClientForCluster(ctx, clustersClient, id.ResourceGroup, id.ClusterName)
+	if err != nil {
+		return err
+	}
+
+	nodeSelector := fmt.Sprintf("agentpool=%s", id.Name)
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: nodeSelector})
+	if err != nil {
+		return fmt.Errorf("listing surviving nodes for Node Pool %q: %+v", id.Name, err)
+	}
+
+	patch := []byte(`{"spec":{"unschedulable":false}}`)
+	for _, node := range nodes.Items {
+		log.Printf("[DEBUG] Un-cordoning surviving Node %q..", node.Name)
+		if _, err := clientset.CoreV1().Nodes().Patch(ctx, node.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			return fmt.Errorf("un-cordoning Node %q: %+v", node.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func jsonAnnotationsPatch(annotations map[string]interface{}) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+}
@@ -0,0 +1,439 @@
+package containers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/helper/validation"
+	"sigs.k8s.io/yaml"
+
+	"github.com/terraform-providers/terraform-provider-azurerm/azurerm/internal/clients"
+	"github.com/terraform-providers/terraform-provider-azurerm/azurerm/internal/services/containers/parse"
+	containerValidate "github.com/terraform-providers/terraform-provider-azurerm/azurerm/internal/services/containers/validate"
+	azSchema "github.com/terraform-providers/terraform-provider-azurerm/azurerm/internal/tf/schema"
+	"github.com/terraform-providers/terraform-provider-azurerm/azurerm/internal/timeouts"
+	"github.com/terraform-providers/terraform-provider-azurerm/azurerm/utils"
+)
+
+// kubernetesNodePoolManifest is the shape accepted by the `manifest` field - a YAML/JSON document
+// (à la `kubernetes_yaml`) describing the labels, taints and Kubernetes-side annotations that should
+// be applied to the target node pool.
+type kubernetesNodePoolManifest struct {
+	NodeLabels  map[string]string `json:"nodeLabels"`
+	NodeTaints  []string          `json:"nodeTaints"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+func resourceArmKubernetesClusterNodePoolManifest() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceArmKubernetesClusterNodePoolManifestCreateUpdate,
+		Read:   resourceArmKubernetesClusterNodePoolManifestRead,
+		Update: resourceArmKubernetesClusterNodePoolManifestCreateUpdate,
+		Delete: resourceArmKubernetesClusterNodePoolManifestDelete,
+
+		Importer: azSchema.ValidateResourceIDPriorToImport(func(id string) error {
+			_, err := parse.KubernetesNodePoolID(id)
+			return err
+		}),
+
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(30 * time.Minute),
+			Read:   schema.DefaultTimeout(5 * time.Minute),
+			Update: schema.DefaultTimeout(30 * time.Minute),
+			Delete: schema.DefaultTimeout(30 * time.Minute),
+		},
+
+		Schema: map[string]*schema.Schema{
+			"node_pool_id": {
+				Type:         schema.TypeString,
+				Required:     true,
+				ForceNew:     true,
+				ValidateFunc: containerValidate.KubernetesNodePoolID,
+			},
+
+			"manifest": {
+				Type:         schema.TypeString,
+				Required:     true,
+				ValidateFunc: validation.StringIsNotEmpty,
+			},
+
+			// The following track exactly what this resource has applied to the node pool/nodes, as of
+			// the last successful apply - not the full live state, which may also carry labels/taints set
+			// directly on `azurerm_kubernetes_cluster_node_pool` that this resource must never touch.
+			// `Read` reconciles them against the live pool/nodes to surface drift, and `Delete` uses them
+			// to remove only the entries this resource owns.
+			"managed_node_labels": {
+				Type:     schema.TypeMap,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+
+			"managed_node_taints": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+
+			"managed_annotations": {
+				Type:     schema.TypeMap,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+		},
+	}
+}
+
+func resourceArmKubernetesClusterNodePoolManifestCreateUpdate(d *schema.ResourceData, meta interface{}) error {
+	poolsClient := meta.(*clients.Client).Containers.AgentPoolsClient
+	ctx, cancel := timeouts.ForCreateUpdate(meta.(*clients.Client).StopContext, d)
+	defer cancel()
+
+	id, err := parse.KubernetesNodePoolID(d.Get("node_pool_id").(string))
+	if err != nil {
+		return err
+	}
+
+	manifest, err := expandKubernetesNodePoolManifest(d.Get("manifest").(string))
+	if err != nil {
+		return fmt.Errorf("parsing `manifest`: %+v", err)
+	}
+
+	log.Printf("[DEBUG] Retrieving Node Pool %q (Kubernetes Cluster %q / Resource Group %q)..", id.Name, id.ClusterName, id.ResourceGroup)
+	existing, err := poolsClient.Get(ctx, id.ResourceGroup, id.ClusterName, id.Name)
+	if err != nil {
+		return fmt.Errorf("retrieving Node Pool %q (Kubernetes Cluster %q / Resource Group %q): %+v", id.Name, id.ClusterName, id.ResourceGroup, err)
+	}
+	if existing.ManagedClusterAgentPoolProfileProperties == nil {
+		return fmt.Errorf("retrieving Node Pool %q (Kubernetes Cluster %q / Resource Group %q): `properties` was nil", id.Name, id.ClusterName, id.ResourceGroup)
+	}
+
+	props := existing.ManagedClusterAgentPoolProfileProperties
+
+	// `node_labels`/`node_taints` aren't `ForceNew` on `azurerm_kubernetes_cluster_node_pool`, so this
+	// resource and that one can manage the same pool at once. To avoid clobbering entries the other
+	// resource owns, only ever touch the subset of keys/taints *this* resource applied last time
+	// (tracked in `managed_node_labels`/`managed_node_taints`) - anything else on the live pool is left
+	// exactly as-is.
+	previouslyManagedLabels := d.Get("managed_node_labels").(map[string]interface{})
+	previouslyManagedTaints := utils.ExpandStringSlice(d.Get("managed_node_taints").([]interface{}))
+
+	needsAgentPoolUpdate := false
+
+	if desired := mergeManagedNodeLabels(props.NodeLabels, previouslyManagedLabels, manifest.NodeLabels); !reflect.DeepEqual(desired, props.NodeLabels) {
+		props.NodeLabels = desired
+		needsAgentPoolUpdate = true
+	}
+
+	if desired := mergeManagedNodeTaints(props.NodeTaints, *previouslyManagedTaints, manifest.NodeTaints); !stringSlicesEqualAsSets(desired, utils.FlattenStringSlice(props.NodeTaints)) {
+		props.NodeTaints = &desired
+		needsAgentPoolUpdate = true
+	}
+
+	if needsAgentPoolUpdate {
+		log.Printf("[DEBUG] Updating Node Labels/Taints on Node Pool %q (Kubernetes Cluster %q / Resource Group %q)..", id.Name, id.ClusterName, id.ResourceGroup)
+		existing.ManagedClusterAgentPoolProfileProperties = props
+		future, err := poolsClient.CreateOrUpdate(ctx, id.ResourceGroup, id.ClusterName, id.Name, existing)
+		if err != nil {
+			return fmt.Errorf("updating Node Pool %q (Kubernetes Cluster %q / Resource Group %q): %+v", id.Name, id.ClusterName, id.ResourceGroup, err)
+		}
+
+		if err := future.WaitForCompletionRef(ctx, poolsClient.Client); err != nil {
+			return fmt.Errorf("waiting for update of Node Pool %q (Kubernetes Cluster %q / Resource Group %q): %+v", id.Name, id.ClusterName, id.ResourceGroup, err)
+		}
+	}
+
+	// AKS doesn't model arbitrary Kubernetes-side annotations against the agent pool, so those are
+	// patched directly against the Node objects via the cluster's kubeconfig. Keys this resource
+	// previously applied but which have since been dropped from `manifest` are cleared with a
+	// merge-patch `null`, rather than left behind.
+	previouslyManagedAnnotations := d.Get("managed_annotations").(map[string]interface{})
+	if patch := annotationsPatch(previouslyManagedAnnotations, manifest.Annotations); len(patch) > 0 {
+		if err := patchNodePoolAnnotations(ctx, meta, id, patch); err != nil {
+			return fmt.Errorf("patching annotations on Node Pool %q (Kubernetes Cluster %q / Resource Group %q): %+v", id.Name, id.ClusterName, id.ResourceGroup, err)
+		}
+	}
+
+	if err := d.Set("managed_node_labels", manifest.NodeLabels); err != nil {
+		return fmt.Errorf("setting `managed_node_labels`: %+v", err)
+	}
+	if err := d.Set("managed_node_taints", manifest.NodeTaints); err != nil {
+		return fmt.Errorf("setting `managed_node_taints`: %+v", err)
+	}
+	if err := d.Set("managed_annotations", manifest.Annotations); err != nil {
+		return fmt.Errorf("setting `managed_annotations`: %+v", err)
+	}
+
+	d.SetId(d.Get("node_pool_id").(string))
+
+	return resourceArmKubernetesClusterNodePoolManifestRead(d, meta)
+}
+
+func resourceArmKubernetesClusterNodePoolManifestRead(d *schema.ResourceData, meta interface{}) error {
+	poolsClient := meta.(*clients.Client).Containers.AgentPoolsClient
+	ctx, cancel := timeouts.ForRead(meta.(*clients.Client).StopContext, d)
+	defer cancel()
+
+	id, err := parse.KubernetesNodePoolID(d.Id())
+	if err != nil {
+		return err
+	}
+
+	resp, err := poolsClient.Get(ctx, id.ResourceGroup, id.ClusterName, id.Name)
+	if err != nil {
+		if utils.ResponseWasNotFound(resp.Response) {
+			log.Printf("[DEBUG] Node Pool %q was not found in Managed Kubernetes Cluster %q / Resource Group %q - removing from state!", id.Name, id.ClusterName, id.ResourceGroup)
+			d.SetId("")
+			return nil
+		}
+
+		return fmt.Errorf("retrieving Node Pool %q (Kubernetes Cluster %q / Resource Group %q): %+v", id.Name, id.ClusterName, id.ResourceGroup, err)
+	}
+
+	d.Set("node_pool_id", d.Id())
+
+	props := resp.ManagedClusterAgentPoolProfileProperties
+
+	trackedLabels := d.Get("managed_node_labels").(map[string]interface{})
+	liveLabels := map[string]string{}
+	for k := range trackedLabels {
+		if props == nil || props.NodeLabels == nil {
+			continue
+		}
+		if v, ok := props.NodeLabels[k]; ok && v != nil {
+			liveLabels[k] = *v
+		}
+		// else: this resource's key was removed out-of-band - drop it from the tracked set too, so
+		// the next apply re-creates it instead of silently assuming it's still there.
+	}
+	if err := d.Set("managed_node_labels", liveLabels); err != nil {
+		return fmt.Errorf("setting `managed_node_labels`: %+v", err)
+	}
+
+	trackedTaints := utils.ExpandStringSlice(d.Get("managed_node_taints").([]interface{}))
+	liveTaintSet := map[string]bool{}
+	if props != nil && props.NodeTaints != nil {
+		for _, t := range *props.NodeTaints {
+			liveTaintSet[t] = true
+		}
+	}
+	liveTaints := make([]string, 0)
+	for _, t := range *trackedTaints {
+		if liveTaintSet[t] {
+			liveTaints = append(liveTaints, t)
+		}
+	}
+	if err := d.Set("managed_node_taints", liveTaints); err != nil {
+		return fmt.Errorf("setting `managed_node_taints`: %+v", err)
+	}
+
+	trackedAnnotations := d.Get("managed_annotations").(map[string]interface{})
+	liveAnnotations := map[string]string{}
+	if len(trackedAnnotations) > 0 {
+		nodeAnnotations, err := nodeAnnotationsForPool(ctx, meta, id)
+		if err != nil {
+			return fmt.Errorf("reconciling annotations for Node Pool %q (Kubernetes Cluster %q / Resource Group %q): %+v", id.Name, id.ClusterName, id.ResourceGroup, err)
+		}
+		for k := range trackedAnnotations {
+			if v, ok := nodeAnnotations[k]; ok {
+				liveAnnotations[k] = v
+			}
+		}
+	}
+	if err := d.Set("managed_annotations", liveAnnotations); err != nil {
+		return fmt.Errorf("setting `managed_annotations`: %+v", err)
+	}
+
+	return nil
+}
+
+func resourceArmKubernetesClusterNodePoolManifestDelete(d *schema.ResourceData, meta interface{}) error {
+	poolsClient := meta.(*clients.Client).Containers.AgentPoolsClient
+	ctx, cancel := timeouts.ForDelete(meta.(*clients.Client).StopContext, d)
+	defer cancel()
+
+	id, err := parse.KubernetesNodePoolID(d.Id())
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[DEBUG] Removing managed Node Labels/Taints from Node Pool %q (Kubernetes Cluster %q / Resource Group %q)..", id.Name, id.ClusterName, id.ResourceGroup)
+	existing, err := poolsClient.Get(ctx, id.ResourceGroup, id.ClusterName, id.Name)
+	if err != nil {
+		if utils.ResponseWasNotFound(existing.Response) {
+			return nil
+		}
+		return fmt.Errorf("retrieving Node Pool %q (Kubernetes Cluster %q / Resource Group %q): %+v", id.Name, id.ClusterName, id.ResourceGroup, err)
+	}
+	if existing.ManagedClusterAgentPoolProfileProperties == nil {
+		return nil
+	}
+
+	// Only remove the specific labels/taints this resource applied - `node_labels`/`node_taints` can
+	// also be set directly on `azurerm_kubernetes_cluster_node_pool`, and those must survive this
+	// resource being destroyed.
+	managedLabels := d.Get("managed_node_labels").(map[string]interface{})
+	managedTaints := utils.ExpandStringSlice(d.Get("managed_node_taints").([]interface{}))
+
+	props := existing.ManagedClusterAgentPoolProfileProperties
+	props.NodeLabels = removeManagedNodeLabels(props.NodeLabels, managedLabels)
+	remainingTaints := removeManagedNodeTaints(props.NodeTaints, *managedTaints)
+	props.NodeTaints = &remainingTaints
+	existing.ManagedClusterAgentPoolProfileProperties = props
+
+	future, err := poolsClient.CreateOrUpdate(ctx, id.ResourceGroup, id.ClusterName, id.Name, existing)
+	if err != nil {
+		return fmt.Errorf("removing managed Node Labels/Taints from Node Pool %q (Kubernetes Cluster %q / Resource Group %q): %+v", id.Name, id.ClusterName, id.ResourceGroup, err)
+	}
+
+	if err := future.WaitForCompletionRef(ctx, poolsClient.Client); err != nil {
+		return fmt.Errorf("waiting for removal of managed Node Labels/Taints from Node Pool %q (Kubernetes Cluster %q / Resource Group %q): %+v", id.Name, id.ClusterName, id.ResourceGroup, err)
+	}
+
+	managedAnnotations := d.Get("managed_annotations").(map[string]interface{})
+	if len(managedAnnotations) > 0 {
+		nullPatch := make(map[string]interface{}, len(managedAnnotations))
+		for k := range managedAnnotations {
+			nullPatch[k] = nil
+		}
+
+		if err := patchNodePoolAnnotations(ctx, meta, id, nullPatch); err != nil {
+			return fmt.Errorf("clearing managed annotations from Node Pool %q (Kubernetes Cluster %q / Resource Group %q): %+v", id.Name, id.ClusterName, id.ResourceGroup, err)
+		}
+	}
+
+	return nil
+}
+
+// mergeManagedNodeLabels starts from the pool's live labels, drops whatever this resource applied on
+// the previous apply (so a label removed from `manifest` doesn't linger) and overlays the manifest's
+// current labels - leaving labels set directly on `azurerm_kubernetes_cluster_node_pool` untouched.
+func mergeManagedNodeLabels(live map[string]*string, previouslyManaged map[string]interface{}, desired map[string]string) map[string]*string {
+	merged := make(map[string]*string)
+	for k, v := range live {
+		if _, wasManaged := previouslyManaged[k]; wasManaged {
+			continue
+		}
+		merged[k] = v
+	}
+
+	for k, v := range desired {
+		v := v
+		merged[k] = &v
+	}
+
+	return merged
+}
+
+// removeManagedNodeLabels strips only the given keys from `live`, leaving every other label alone.
+func removeManagedNodeLabels(live map[string]*string, managed map[string]interface{}) map[string]*string {
+	remaining := make(map[string]*string)
+	for k, v := range live {
+		if _, isManaged := managed[k]; isManaged {
+			continue
+		}
+		remaining[k] = v
+	}
+
+	return remaining
+}
+
+// mergeManagedNodeTaints is the taint-list equivalent of mergeManagedNodeLabels: it drops whichever
+// taints this resource previously applied from the live list, then appends the manifest's current set.
+func mergeManagedNodeTaints(live *[]string, previouslyManaged []string, desired []string) []string {
+	managedSet := make(map[string]bool, len(previouslyManaged))
+	for _, t := range previouslyManaged {
+		managedSet[t] = true
+	}
+
+	merged := make([]string, 0)
+	if live != nil {
+		for _, t := range *live {
+			if managedSet[t] {
+				continue
+			}
+			merged = append(merged, t)
+		}
+	}
+
+	merged = append(merged, desired...)
+	return merged
+}
+
+// removeManagedNodeTaints strips only the given taints from `live`, leaving any other taints intact.
+func removeManagedNodeTaints(live *[]string, managed []string) []string {
+	managedSet := make(map[string]bool, len(managed))
+	for _, t := range managed {
+		managedSet[t] = true
+	}
+
+	remaining := make([]string, 0)
+	if live != nil {
+		for _, t := range *live {
+			if !managedSet[t] {
+				remaining = append(remaining, t)
+			}
+		}
+	}
+
+	return remaining
+}
+
+// stringSlicesEqualAsSets compares two string slices ignoring order - the agent pool API doesn't
+// guarantee it preserves the order taints were submitted in.
+func stringSlicesEqualAsSets(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	counts := make(map[string]int, len(a))
+	for _, v := range a {
+		counts[v]++
+	}
+	for _, v := range b {
+		counts[v]--
+	}
+	for _, c := range counts {
+		if c != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// annotationsPatch builds the merge-patch body for `manifest.annotations`: `desired`'s entries are set
+// as-is, and any key this resource previously managed but which has since been dropped from `manifest`
+// is set to `nil` (JSON `null`), which a merge-patch (RFC 7396) interprets as "delete this key".
+func annotationsPatch(previouslyManaged map[string]interface{}, desired map[string]string) map[string]interface{} {
+	patch := make(map[string]interface{}, len(desired)+len(previouslyManaged))
+	for k, v := range desired {
+		patch[k] = v
+	}
+	for k := range previouslyManaged {
+		if _, stillDesired := desired[k]; !stillDesired {
+			patch[k] = nil
+		}
+	}
+
+	return patch
+}
+
+func expandKubernetesNodePoolManifest(raw string) (*kubernetesNodePoolManifest, error) {
+	var manifest kubernetesNodePoolManifest
+	if err := yaml.Unmarshal([]byte(raw), &manifest); err != nil {
+		return nil, err
+	}
+
+	return &manifest, nil
+}
+
+// patchNodePoolAnnotations fetches the cluster's kubeconfig and patches the given annotations onto
+// every Node backing the target pool - this is the same kubeconfig-backed approach used to drain
+// nodes in `drainNodePool`. A `nil` value clears the corresponding annotation.
+func patchNodePoolAnnotations(ctx context.Context, meta interface{}, id *parse.KubernetesNodePoolId, annotations map[string]interface{}) error {
+	return patchNodesForPool(ctx, meta, id, annotations)
+}
@@ -1,12 +1,15 @@
 package containers
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"regexp"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/services/containerservice/mgmt/2020-02-01/containerservice"
+	"github.com/hashicorp/terraform-plugin-sdk/helper/resource"
 	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
 	"github.com/hashicorp/terraform-plugin-sdk/helper/validation"
 	"github.com/terraform-providers/terraform-provider-azurerm/azurerm/helpers/azure"
@@ -113,19 +116,21 @@ func resourceArmKubernetesClusterNodePool() *schema.Resource {
 				ValidateFunc: validation.IntBetween(1, 100),
 			},
 
+			// NOTE: no longer `ForceNew` - this can now be updated in-place, and is also managed out-of-band
+			// by the companion `azurerm_kubernetes_node_pool_manifest` resource.
 			"node_labels": {
 				Type:     schema.TypeMap,
 				Optional: true,
 				Computed: true,
-				ForceNew: true,
 				Elem:     &schema.Schema{Type: schema.TypeString},
 			},
 
+			// NOTE: no longer `ForceNew` - this can now be updated in-place, and is also managed out-of-band
+			// by the companion `azurerm_kubernetes_node_pool_manifest` resource.
 			"node_taints": {
 				Type:     schema.TypeList,
 				Optional: true,
 				Computed: true,
-				ForceNew: true,
 				Elem:     &schema.Schema{Type: schema.TypeString},
 			},
 
@@ -176,11 +181,113 @@ func resourceArmKubernetesClusterNodePool() *schema.Resource {
 				}, false),
 			},
 
-			"max_bid_price": {
+			// NOTE: `-1` is a valid, explicit sentinel here meaning "pay up to the on-demand price".
+			"spot_max_price": {
 				Type:         schema.TypeFloat,
 				Optional:     true,
 				ForceNew:     true,
-				ValidateFunc: validate.MaxBidPrice,
+				ValidateFunc: validateKubernetesNodePoolSpotMaxPrice,
+			},
+
+			"proximity_placement_group_id": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				ValidateFunc: azure.ValidateResourceID,
+			},
+
+			"host_group_id": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				ValidateFunc: azure.ValidateResourceID,
+			},
+
+			"orchestrator_version": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ValidateFunc: validation.StringIsNotEmpty,
+			},
+
+			"mode": {
+				Type:     schema.TypeString,
+				Optional: true,
+				// additional node pools default to `User` - `System` carries the scheduling
+				// constraints for critical add-ons and should be opted into explicitly.
+				Default: string(containerservice.User),
+				ValidateFunc: validation.StringInSlice([]string{
+					string(containerservice.System),
+					string(containerservice.User),
+				}, false),
+			},
+
+			"node_image_version": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"upgrade_settings": {
+				Type:     schema.TypeList,
+				Optional: true,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"max_surge": {
+							Type:         schema.TypeString,
+							Required:     true,
+							ValidateFunc: validation.StringIsNotEmpty,
+						},
+					},
+				},
+			},
+
+			"drain_on_delete": {
+				Type:     schema.TypeList,
+				Optional: true,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"grace_period_seconds": {
+							Type:         schema.TypeInt,
+							Optional:     true,
+							Default:      30,
+							ValidateFunc: validation.IntAtLeast(0),
+						},
+
+						"delete_local_data": {
+							Type:     schema.TypeBool,
+							Optional: true,
+						},
+
+						"force": {
+							Type:     schema.TypeBool,
+							Optional: true,
+						},
+
+						"ignore_daemonsets": {
+							Type:     schema.TypeBool,
+							Optional: true,
+							Default:  true,
+						},
+
+						"pod_selector": {
+							Type:         schema.TypeString,
+							Optional:     true,
+							ValidateFunc: validation.StringIsNotEmpty,
+						},
+
+						"timeout": {
+							Type:     schema.TypeString,
+							Optional: true,
+							Default:  "5m",
+							ValidateFunc: validation.StringMatch(
+								regexp.MustCompile(`^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`),
+								"`timeout` must be a valid Go duration (e.g. `30s`, `5m`, `1h`)",
+							),
+						},
+					},
+				},
 			},
 		},
 	}
@@ -189,13 +296,13 @@ func resourceArmKubernetesClusterNodePool() *schema.Resource {
 func customizeDiff(d *schema.ResourceDiff, v interface{}) error {
 	priority, _ := d.GetOk("priority")
 	_, hasEvictionPolicy := d.GetOk("eviction_policy")
-	_, hasMaxBidPrice := d.GetOk("max_bid_price")
+	_, hasSpotMaxPrice := d.GetOk("spot_max_price")
 
 	errMsg := ""
 
 	if priority.(string) == string(containerservice.Regular) {
-		if hasMaxBidPrice {
-			errMsg = "`priority` must be set to `Spot` if `max_bid_price` is specified"
+		if hasSpotMaxPrice {
+			errMsg = "`priority` must be set to `Spot` if `spot_max_price` is specified"
 		}
 
 		if hasEvictionPolicy {
@@ -319,10 +426,30 @@ func resourceArmKubernetesClusterNodePoolCreate(d *schema.ResourceData, meta int
 		profile.ScaleSetEvictionPolicy = containerservice.ScaleSetEvictionPolicy(scaleSetEvictionPolicy)
 	}
 
-	if spotPrice := d.Get("max_bid_price").(float64); spotPrice != 0 {
+	if spotPrice := d.Get("spot_max_price").(float64); spotPrice != 0 {
 		profile.SpotMaxPrice = utils.Float(spotPrice)
 	}
 
+	if orchestratorVersion := d.Get("orchestrator_version").(string); orchestratorVersion != "" {
+		profile.OrchestratorVersion = utils.String(orchestratorVersion)
+	}
+
+	if mode := d.Get("mode").(string); mode != "" {
+		profile.Mode = containerservice.AgentPoolMode(mode)
+	}
+
+	if upgradeSettingsRaw := d.Get("upgrade_settings").([]interface{}); len(upgradeSettingsRaw) > 0 {
+		profile.UpgradeSettings = expandKubernetesNodePoolUpgradeSettings(upgradeSettingsRaw)
+	}
+
+	if proximityPlacementGroupId := d.Get("proximity_placement_group_id").(string); proximityPlacementGroupId != "" {
+		profile.ProximityPlacementGroupID = utils.String(proximityPlacementGroupId)
+	}
+
+	if hostGroupId := d.Get("host_group_id").(string); hostGroupId != "" {
+		profile.HostGroupID = utils.String(hostGroupId)
+	}
+
 	maxCount := d.Get("max_count").(int)
 	minCount := d.Get("min_count").(int)
 
@@ -414,6 +541,39 @@ func resourceArmKubernetesClusterNodePoolUpdate(d *schema.ResourceData, meta int
 
 	log.Printf("[DEBUG] Determining delta for existing Node Pool %q (Kubernetes Cluster %q / Resource Group %q)..", id.Name, id.ClusterName, id.ResourceGroup)
 
+	// orchestrator version pinning/upgrades are a separate, long-running operation from the rest of the
+	// agent pool properties - so if that's the only thing that's changed we send the existing profile with
+	// just the new version via `CreateOrUpdate` (there's no separate upgrade endpoint call), wait for that
+	// operation, and then poll until the pool has returned to a `Succeeded` provisioning state.
+	otherFieldsChanged := d.HasChange("availability_zones") || d.HasChange("enable_auto_scaling") || d.HasChange("enable_node_public_ip") ||
+		d.HasChange("max_count") || d.HasChange("min_count") || d.HasChange("node_count") || d.HasChange("mode") ||
+		d.HasChange("upgrade_settings") || d.HasChange("tags") || d.HasChange("node_labels") || d.HasChange("node_taints")
+
+	if d.HasChange("orchestrator_version") && !otherFieldsChanged {
+		orchestratorVersion := d.Get("orchestrator_version").(string)
+		log.Printf("[DEBUG] Upgrading Node Pool %q (Kubernetes Cluster %q / Resource Group %q) to Orchestrator Version %q..", id.Name, id.ClusterName, id.ResourceGroup, orchestratorVersion)
+
+		props.OrchestratorVersion = utils.String(orchestratorVersion)
+		existing.ManagedClusterAgentPoolProfileProperties = props
+
+		future, err := client.CreateOrUpdate(ctx, id.ResourceGroup, id.ClusterName, id.Name, existing)
+		if err != nil {
+			return fmt.Errorf("upgrading Orchestrator Version for Node Pool %q (Kubernetes Cluster %q / Resource Group %q): %+v", id.Name, id.ClusterName, id.ResourceGroup, err)
+		}
+
+		if err := future.WaitForCompletionRef(ctx, client.Client); err != nil {
+			return fmt.Errorf("waiting for Orchestrator Version upgrade of Node Pool %q (Kubernetes Cluster %q / Resource Group %q): %+v", id.Name, id.ClusterName, id.ResourceGroup, err)
+		}
+
+		if err := waitForNodePoolProvisioningState(ctx, client, id); err != nil {
+			return err
+		}
+
+		d.Partial(false)
+
+		return resourceArmKubernetesClusterNodePoolRead(d, meta)
+	}
+
 	// delta patching
 	if d.HasChange("availability_zones") {
 		availabilityZonesRaw := d.Get("availability_zones").([]interface{})
@@ -442,6 +602,29 @@ func resourceArmKubernetesClusterNodePoolUpdate(d *schema.ResourceData, meta int
 		props.Count = utils.Int32(int32(d.Get("node_count").(int)))
 	}
 
+	if d.HasChange("node_labels") {
+		nodeLabelsRaw := d.Get("node_labels").(map[string]interface{})
+		props.NodeLabels = utils.ExpandMapStringPtrString(nodeLabelsRaw)
+	}
+
+	if d.HasChange("node_taints") {
+		nodeTaintsRaw := d.Get("node_taints").([]interface{})
+		props.NodeTaints = utils.ExpandStringSlice(nodeTaintsRaw)
+	}
+
+	if d.HasChange("orchestrator_version") {
+		props.OrchestratorVersion = utils.String(d.Get("orchestrator_version").(string))
+	}
+
+	if d.HasChange("mode") {
+		props.Mode = containerservice.AgentPoolMode(d.Get("mode").(string))
+	}
+
+	if d.HasChange("upgrade_settings") {
+		upgradeSettingsRaw := d.Get("upgrade_settings").([]interface{})
+		props.UpgradeSettings = expandKubernetesNodePoolUpgradeSettings(upgradeSettingsRaw)
+	}
+
 	if d.HasChange("tags") {
 		t := d.Get("tags").(map[string]interface{})
 		props.Tags = tags.Expand(t)
@@ -477,6 +660,17 @@ func resourceArmKubernetesClusterNodePoolUpdate(d *schema.ResourceData, meta int
 		props.MinCount = nil
 	}
 
+	scalingDown := isNodePoolScalingDown(d)
+	drainedForScaleDown := false
+	if scalingDown {
+		if drainRaw := d.Get("drain_on_delete").([]interface{}); len(drainRaw) > 0 {
+			if err := drainNodePool(ctx, meta, id, drainRaw[0].(map[string]interface{})); err != nil {
+				return fmt.Errorf("draining Node Pool %q (Kubernetes Cluster %q / Resource Group %q) prior to scale-down: %+v", id.Name, id.ClusterName, id.ResourceGroup, err)
+			}
+			drainedForScaleDown = true
+		}
+	}
+
 	log.Printf("[DEBUG] Updating existing Node Pool %q (Kubernetes Cluster %q / Resource Group %q)..", id.Name, id.ClusterName, id.ResourceGroup)
 	existing.ManagedClusterAgentPoolProfileProperties = props
 	future, err := client.CreateOrUpdate(ctx, id.ResourceGroup, id.ClusterName, id.Name, existing)
@@ -488,6 +682,12 @@ func resourceArmKubernetesClusterNodePoolUpdate(d *schema.ResourceData, meta int
 		return fmt.Errorf("waiting for update of Node Pool %q (Kubernetes Cluster %q / Resource Group %q): %+v", id.Name, id.ClusterName, id.ResourceGroup, err)
 	}
 
+	if drainedForScaleDown {
+		if err := uncordonSurvivingNodes(ctx, meta, id); err != nil {
+			return fmt.Errorf("un-cordoning surviving nodes of Node Pool %q (Kubernetes Cluster %q / Resource Group %q): %+v", id.Name, id.ClusterName, id.ResourceGroup, err)
+		}
+	}
+
 	d.Partial(false)
 
 	return resourceArmKubernetesClusterNodePoolRead(d, meta)
@@ -581,7 +781,28 @@ func resourceArmKubernetesClusterNodePoolRead(d *schema.ResourceData, meta inter
 
 		d.Set("priority", string(props.ScaleSetPriority))
 		d.Set("eviction_policy", string(props.ScaleSetEvictionPolicy))
-		d.Set("max_bid_price", props.SpotMaxPrice)
+		d.Set("spot_max_price", props.SpotMaxPrice)
+
+		orchestratorVersion := ""
+		if props.OrchestratorVersion != nil {
+			orchestratorVersion = *props.OrchestratorVersion
+		}
+		d.Set("orchestrator_version", orchestratorVersion)
+
+		d.Set("mode", string(props.Mode))
+
+		nodeImageVersion := ""
+		if props.NodeImageVersion != nil {
+			nodeImageVersion = *props.NodeImageVersion
+		}
+		d.Set("node_image_version", nodeImageVersion)
+
+		if err := d.Set("upgrade_settings", flattenKubernetesNodePoolUpgradeSettings(props.UpgradeSettings)); err != nil {
+			return fmt.Errorf("setting `upgrade_settings`: %+v", err)
+		}
+
+		d.Set("proximity_placement_group_id", props.ProximityPlacementGroupID)
+		d.Set("host_group_id", props.HostGroupID)
 	}
 
 	return tags.FlattenAndSet(d, resp.Tags)
@@ -597,6 +818,12 @@ func resourceArmKubernetesClusterNodePoolDelete(d *schema.ResourceData, meta int
 		return err
 	}
 
+	if drainRaw := d.Get("drain_on_delete").([]interface{}); len(drainRaw) > 0 {
+		if err := drainNodePool(ctx, meta, id, drainRaw[0].(map[string]interface{})); err != nil {
+			return fmt.Errorf("draining Node Pool %q (Kubernetes Cluster %q / Resource Group %q) prior to deletion: %+v", id.Name, id.ClusterName, id.ResourceGroup, err)
+		}
+	}
+
 	future, err := client.Delete(ctx, id.ResourceGroup, id.ClusterName, id.Name)
 	if err != nil {
 		return fmt.Errorf("deleting Node Pool %q (Managed Kubernetes Cluster %q / Resource Group %q): %+v", id.Name, id.ClusterName, id.ResourceGroup, err)
@@ -608,3 +835,103 @@ func resourceArmKubernetesClusterNodePoolDelete(d *schema.ResourceData, meta int
 
 	return nil
 }
+
+// isNodePoolScalingDown returns true if either `node_count` or `min_count` has been reduced, which
+// is when a `drain_on_delete` block (if configured) needs to cordon and evict pods from the pool
+// before the update - since Azure (not Terraform) picks which VMSS instances actually get removed,
+// every node is cordoned, and any that survive are un-cordoned again once the update completes.
+func isNodePoolScalingDown(d *schema.ResourceData) bool {
+	if old, new := d.GetChange("node_count"); d.HasChange("node_count") && new.(int) < old.(int) {
+		return true
+	}
+
+	if old, new := d.GetChange("min_count"); d.HasChange("min_count") && new.(int) < old.(int) {
+		return true
+	}
+
+	return false
+}
+
+// validateKubernetesNodePoolSpotMaxPrice allows any positive price, or the explicit `-1` sentinel
+// meaning "pay up to the on-demand price" - mirroring the `spotMaxPrice` field in the Azure API,
+// which accepts exactly those two shapes.
+func validateKubernetesNodePoolSpotMaxPrice(i interface{}, k string) (warnings []string, errors []error) {
+	v, ok := i.(float64)
+	if !ok {
+		errors = append(errors, fmt.Errorf("expected type of %q to be float64", k))
+		return warnings, errors
+	}
+
+	if v != -1 && v <= 0 {
+		errors = append(errors, fmt.Errorf("%q must be a positive value, or `-1` to allow the Spot price to rise to the on-demand price, got %f", k, v))
+	}
+
+	return warnings, errors
+}
+
+func expandKubernetesNodePoolUpgradeSettings(input []interface{}) *containerservice.AgentPoolUpgradeSettings {
+	if len(input) == 0 || input[0] == nil {
+		return nil
+	}
+
+	v := input[0].(map[string]interface{})
+	return &containerservice.AgentPoolUpgradeSettings{
+		MaxSurge: utils.String(v["max_surge"].(string)),
+	}
+}
+
+func flattenKubernetesNodePoolUpgradeSettings(input *containerservice.AgentPoolUpgradeSettings) []interface{} {
+	if input == nil {
+		return []interface{}{}
+	}
+
+	maxSurge := ""
+	if input.MaxSurge != nil {
+		maxSurge = *input.MaxSurge
+	}
+
+	return []interface{}{
+		map[string]interface{}{
+			"max_surge": maxSurge,
+		},
+	}
+}
+
+// waitForNodePoolProvisioningState polls the Node Pool until its `provisioningState` has returned to
+// `Succeeded`; it's used after a targeted upgrade (e.g. an Orchestrator Version bump) once the
+// long-running operation's own poller has completed.
+func waitForNodePoolProvisioningState(ctx context.Context, client *containerservice.AgentPoolsClient, id *parse.KubernetesNodePoolId) error {
+	log.Printf("[DEBUG] Waiting for Node Pool %q (Kubernetes Cluster %q / Resource Group %q) to return to Provisioning State `Succeeded`..", id.Name, id.ClusterName, id.ResourceGroup)
+	stateConf := &resource.StateChangeConf{
+		Pending:    []string{"Upgrading", "Updating", "Scaling"},
+		Target:     []string{"Succeeded"},
+		Refresh:    kubernetesNodePoolProvisioningStateRefreshFunc(ctx, client, id),
+		MinTimeout: 15 * time.Second,
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		stateConf.Timeout = time.Until(deadline)
+	}
+
+	if _, err := stateConf.WaitForState(); err != nil {
+		return fmt.Errorf("waiting for Provisioning State of Node Pool %q (Kubernetes Cluster %q / Resource Group %q): %+v", id.Name, id.ClusterName, id.ResourceGroup, err)
+	}
+
+	return nil
+}
+
+func kubernetesNodePoolProvisioningStateRefreshFunc(ctx context.Context, client *containerservice.AgentPoolsClient, id *parse.KubernetesNodePoolId) resource.StateRefreshFunc {
+	return func() (interface{}, string, error) {
+		resp, err := client.Get(ctx, id.ResourceGroup, id.ClusterName, id.Name)
+		if err != nil {
+			return nil, "", fmt.Errorf("retrieving Node Pool %q (Kubernetes Cluster %q / Resource Group %q): %+v", id.Name, id.ClusterName, id.ResourceGroup, err)
+		}
+
+		provisioningState := ""
+		if props := resp.ManagedClusterAgentPoolProfileProperties; props != nil && props.ProvisioningState != nil {
+			provisioningState = *props.ProvisioningState
+		}
+
+		return resp, provisioningState, nil
+	}
+}
@@ -0,0 +1,35 @@
+package containers
+
+import (
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+)
+
+// Registration implements the Container service's registration with the provider. This snapshot of
+// the package only contains the node-pool resources below; the rest of the Container service
+// (clusters, registries, container groups, etc.) is registered elsewhere and isn't part of this tree.
+type Registration struct{}
+
+// Name is the name of this Service
+func (r Registration) Name() string {
+	return "Container"
+}
+
+// WebsiteCategories returns the categories used for the website
+func (r Registration) WebsiteCategories() []string {
+	return []string{
+		"Container",
+	}
+}
+
+// SupportedDataSources returns the supported Data Sources supported by this Service
+func (r Registration) SupportedDataSources() map[string]*schema.Resource {
+	return map[string]*schema.Resource{}
+}
+
+// SupportedResources returns the supported Resources supported by this Service
+func (r Registration) SupportedResources() map[string]*schema.Resource {
+	return map[string]*schema.Resource{
+		"azurerm_kubernetes_cluster_node_pool":  resourceArmKubernetesClusterNodePool(),
+		"azurerm_kubernetes_node_pool_manifest": resourceArmKubernetesClusterNodePoolManifest(),
+	}
+}